@@ -16,7 +16,10 @@ import (
 	"time"
 )
 
-const maxValueSize = 1024 * 256
+// maxValueSize is the largest payload PostValue will accept. It defaults to
+// a conservative inline-storage limit, and is raised by main.go when the S3
+// backend is enabled.
+var maxValueSize int64 = 1024 * 256
 
 func init() {
 	mapper.CustomTypes[reflect.TypeOf(Token{})] = func(value string, target reflect.Value) error {
@@ -41,6 +44,11 @@ func init() {
 
 type API struct {
 	kv KVStore
+
+	// validation holds the cached per-token validation rules; PostValue
+	// rejects payloads that violate a matching rule. A nil value disables
+	// validation.
+	validation *ValidationRules
 }
 
 func (api API) RegisterTo(router *httprouter.Router) {
@@ -51,9 +59,10 @@ func (api API) RegisterTo(router *httprouter.Router) {
 
 func (api API) PostValue() httprouter.Handle {
 	type requestValues struct {
-		Token   Token `path:"token" validate:"required"`
-		Key     Key   `path:"key" validate:"required"`
-		Version int   `path:"version"`
+		Token      Token `path:"token" validate:"required"`
+		Key        Key   `path:"key" validate:"required"`
+		Version    int   `path:"version"`
+		TTLSeconds int   `query:"ttl"`
 	}
 
 	type resultValues struct {
@@ -82,8 +91,15 @@ func (api API) PostValue() httprouter.Handle {
 				return nil, errors.WithMessage(err, "reading request body")
 			}
 
+			if api.validation != nil {
+				if err := api.validation.Validate(opts.Token, opts.Key, r.Header.Get("Content-Type"), payload); err != nil {
+					return nil, err
+				}
+			}
+
 			// store in database.
-			updatedVersion, err := api.kv.Put(opts.Token, opts.Key, payload, opts.Version)
+			ttl := time.Duration(opts.TTLSeconds) * time.Second
+			updatedVersion, err := api.kv.Put(opts.Token, opts.Key, payload, opts.Version, ttl)
 
 			// lets check how often this happens
 			if err == ErrVersionConflict {
@@ -211,22 +227,44 @@ func (t Token) String() string {
 
 type KVStore struct {
 	db *sqlx.DB
+
+	// blobs is nil unless the S3 backend was enabled on the command line,
+	// in which case values larger than blobs.threshold are offloaded to it.
+	blobs *blobStore
 }
 
-func (kv *KVStore) Put(token Token, key Key, value []byte, version int) (int, error) {
+// Put stores value under (token, key). ttl of zero means the value never
+// expires; otherwise Get treats the row as gone once ttl has elapsed.
+func (kv *KVStore) Put(token Token, key Key, value []byte, version int, ttl time.Duration) (int, error) {
+	payload, backend, objectKey, sha256Hex, err := kv.prepareStorage(token, value)
+	if err != nil {
+		return 0, err
+	}
+
 	var updatedVersion int
+	now := time.Now()
 
-	err := transaction(kv.db, func(tx *sqlx.Tx) error {
+	var expiresAt sql.NullTime
+	if ttl > 0 {
+		expiresAt = sql.NullTime{Time: now.Add(ttl), Valid: true}
+	}
+
+	err = transaction(kv.db, func(tx *sqlx.Tx) error {
 		err := tx.Get(&updatedVersion, `
-				INSERT INTO kv_data (token, key, version, created, payload)
-				VALUES ($1, $2, $3+1, $4, $5)
+				INSERT INTO kv_data (token, key, version, created, payload, storage_backend, object_key, sha256, expires_at, incarnation)
+				VALUES ($1, $2, $3+1, $4, $5, $6, $7, $8, $9,
+					COALESCE((SELECT max(incarnation)+1 FROM kv_data_history WHERE token=$1 AND key=$2), 0))
 				ON CONFLICT (token, key) DO UPDATE SET
-					created=EXCLUDED.created, 
+					created=EXCLUDED.created,
 					payload=EXCLUDED.payload,
-					version=EXCLUDED.version
+					version=EXCLUDED.version,
+					storage_backend=EXCLUDED.storage_backend,
+					object_key=EXCLUDED.object_key,
+					sha256=EXCLUDED.sha256,
+					expires_at=EXCLUDED.expires_at
 					WHERE (kv_data.version=$3 OR $3=0)
 				RETURNING kv_data.version`,
-			uuid.UUID(token), string(key), version, time.Now(), value)
+			uuid.UUID(token), string(key), version, now, payload, backend, objectKey, sha256Hex, expiresAt)
 
 		// The only case in which we find no rows to update is that the
 		// version mismatches.
@@ -234,22 +272,40 @@ func (kv *KVStore) Put(token Token, key Key, value []byte, version int) (int, er
 			return ErrVersionConflict
 		}
 
-		return err
+		if err != nil {
+			return err
+		}
+
+		return enqueueOutbox(tx, PutEvent{
+			Token: token, Key: key, Version: updatedVersion, Event: eventPut, Timestamp: now,
+		})
 	})
 
+	if err == nil {
+		if backend == storageBackendS3 {
+			metricBackendS3.Mark(1)
+		} else {
+			metricBackendInline.Mark(1)
+		}
+	}
+
 	return updatedVersion, err
 }
 
 func (kv *KVStore) Get(token Token, key Key) ([]byte, int, error) {
 	var result struct {
-		Value   []byte `db:"payload"`
-		Version int    `db:"version"`
+		Value          []byte         `db:"payload"`
+		Version        int            `db:"version"`
+		StorageBackend string         `db:"storage_backend"`
+		ObjectKey      sql.NullString `db:"object_key"`
 	}
 
-	// read the value form the database.
+	// read the value from the database. Rows past their expires_at are
+	// treated as if they were already deleted.
 	err := transaction(kv.db, func(tx *sqlx.Tx) error {
-		return tx.Get(&result,
-			`SELECT payload, version FROM kv_data WHERE token=$1 AND key=$2`,
+		return tx.Get(&result, `
+			SELECT payload, version, storage_backend, object_key FROM kv_data
+			WHERE token=$1 AND key=$2 AND (expires_at IS NULL OR expires_at > now())`,
 			uuid.UUID(token), string(key))
 	})
 
@@ -257,5 +313,18 @@ func (kv *KVStore) Get(token Token, key Key) ([]byte, int, error) {
 		return nil, 0, ErrNoSuchKey
 	}
 
-	return result.Value, result.Version, err
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if result.StorageBackend == storageBackendS3 {
+		if kv.blobs == nil {
+			return nil, 0, errors.New("value is stored in s3, but no s3 backend is configured")
+		}
+
+		value, err := kv.blobs.Get(result.ObjectKey.String)
+		return value, result.Version, errors.WithMessage(err, "fetch from object store")
+	}
+
+	return result.Value, result.Version, nil
 }
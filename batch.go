@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/flachnetz/startup/lib/httputil"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Batches are capped independently of the per-item maxValueSize so that a
+// single request cannot force an unbounded amount of memory to be read.
+const (
+	maxBatchItems = 128
+	maxBatchBytes = 4 * 1024 * 1024
+)
+
+var ErrBatchTooLarge = errors.New("batch too large")
+
+// ErrBatchRolledBack is reported for every item that itself passed its
+// version check but was rolled back because another item in the same
+// batch conflicted.
+var ErrBatchRolledBack = errors.New("batch rolled back due to a conflicting item")
+
+func init() {
+	httputil.ErrorMapping[ErrBatchTooLarge] = http.StatusRequestEntityTooLarge
+}
+
+type BatchPutItem struct {
+	Key     Key    `json:"key"`
+	Version int    `json:"version"`
+	Value   []byte `json:"value"`
+}
+
+type BatchPutResult struct {
+	Key     Key    `json:"key"`
+	Version int    `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BatchGetResult struct {
+	Key     Key    `json:"key"`
+	Version int    `json:"version,omitempty"`
+	Value   []byte `json:"value,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+var (
+	metricBatchPut      = metrics.GetOrRegisterMeter("value.batch.put", nil)
+	metricBatchGet      = metrics.GetOrRegisterMeter("value.batch.get", nil)
+	metricBatchConflict = metrics.GetOrRegisterMeter("value.batch.partial_conflict", nil)
+)
+
+// BatchPut applies every item in a single transaction: if any item's
+// version check fails the whole batch is rolled back, but the returned
+// results still describe which keys conflicted so the caller can decide
+// what to retry.
+func (kv *KVStore) BatchPut(token Token, items []BatchPutItem) ([]BatchPutResult, error) {
+	metricBatchPut.Mark(1)
+
+	if len(items) > maxBatchItems {
+		return nil, ErrBatchTooLarge
+	}
+
+	var totalSize int
+	for _, item := range items {
+		if int64(len(item.Value)) > maxValueSize {
+			return nil, ErrValueTooLarge
+		}
+
+		totalSize += len(item.Value)
+	}
+
+	if totalSize > maxBatchBytes {
+		return nil, ErrBatchTooLarge
+	}
+
+	// Resolve storage the same way Put does, before opening the
+	// transaction, so a large item is offloaded to the blob store instead
+	// of being written as a multi-MB bytea row.
+	type prepared struct {
+		payload           []byte
+		backend           string
+		objectKey, sha256 sql.NullString
+	}
+
+	preparedItems := make([]prepared, len(items))
+	for i, item := range items {
+		payload, backend, objectKey, sha256Hex, err := kv.prepareStorage(token, item.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		preparedItems[i] = prepared{payload, backend, objectKey, sha256Hex}
+	}
+
+	// outcome is only trustworthy once we know whether the transaction
+	// committed: version numbers from RETURNING are discarded by a
+	// rollback, so results must not be built until after transaction()
+	// returns.
+	type outcome struct {
+		version  int
+		conflict bool
+	}
+
+	outcomes := make([]outcome, len(items))
+	conflict := false
+
+	err := transaction(kv.db, func(tx *sqlx.Tx) error {
+		for i, item := range items {
+			now := time.Now()
+			p := preparedItems[i]
+
+			var updatedVersion int
+			err := tx.Get(&updatedVersion, `
+					INSERT INTO kv_data (token, key, version, created, payload, storage_backend, object_key, sha256, incarnation)
+					VALUES ($1, $2, $3+1, $4, $5, $6, $7, $8,
+						COALESCE((SELECT max(incarnation)+1 FROM kv_data_history WHERE token=$1 AND key=$2), 0))
+					ON CONFLICT (token, key) DO UPDATE SET
+						created=EXCLUDED.created,
+						payload=EXCLUDED.payload,
+						version=EXCLUDED.version,
+						storage_backend=EXCLUDED.storage_backend,
+						object_key=EXCLUDED.object_key,
+						sha256=EXCLUDED.sha256
+						WHERE (kv_data.version=$3 OR $3=0)
+					RETURNING kv_data.version`,
+				uuid.UUID(token), string(item.Key), item.Version, now, p.payload, p.backend, p.objectKey, p.sha256)
+
+			if err == sql.ErrNoRows {
+				outcomes[i] = outcome{conflict: true}
+				conflict = true
+				continue
+			}
+
+			if err != nil {
+				return errors.WithMessagef(err, "put key %q", item.Key)
+			}
+
+			if err := enqueueOutbox(tx, PutEvent{
+				Token: token, Key: item.Key, Version: updatedVersion, Event: eventPut, Timestamp: now,
+			}); err != nil {
+				return err
+			}
+
+			outcomes[i] = outcome{version: updatedVersion}
+		}
+
+		if conflict {
+			// roll back: either the whole batch is applied, or none of it is.
+			return ErrVersionConflict
+		}
+
+		return nil
+	})
+
+	results := make([]BatchPutResult, len(items))
+	for i, item := range items {
+		switch {
+		case err == nil:
+			results[i] = BatchPutResult{Key: item.Key, Version: outcomes[i].version}
+			if preparedItems[i].backend == storageBackendS3 {
+				metricBackendS3.Mark(1)
+			} else {
+				metricBackendInline.Mark(1)
+			}
+		case outcomes[i].conflict:
+			results[i] = BatchPutResult{Key: item.Key, Error: ErrVersionConflict.Error()}
+		case err == ErrVersionConflict:
+			results[i] = BatchPutResult{Key: item.Key, Error: ErrBatchRolledBack.Error()}
+		default:
+			results[i] = BatchPutResult{Key: item.Key, Error: err.Error()}
+		}
+	}
+
+	if err == ErrVersionConflict {
+		metricBatchConflict.Mark(1)
+		return results, err
+	}
+
+	return results, err
+}
+
+// BatchGet fetches every requested key with a single query and returns the
+// results in the same order as keys, with ErrNoSuchKey sentinels for keys
+// that do not exist.
+func (kv *KVStore) BatchGet(token Token, keys []Key) ([]BatchGetResult, error) {
+	metricBatchGet.Mark(1)
+
+	if len(keys) > maxBatchItems {
+		return nil, ErrBatchTooLarge
+	}
+
+	keyStrings := make([]string, len(keys))
+	for i, key := range keys {
+		keyStrings[i] = string(key)
+	}
+
+	var rows []struct {
+		Key            string         `db:"key"`
+		Value          []byte         `db:"payload"`
+		Version        int            `db:"version"`
+		StorageBackend string         `db:"storage_backend"`
+		ObjectKey      sql.NullString `db:"object_key"`
+	}
+
+	err := transaction(kv.db, func(tx *sqlx.Tx) error {
+		return tx.Select(&rows, `
+			SELECT key, payload, version, storage_backend, object_key
+			FROM kv_data WHERE token=$1 AND key = ANY($2)
+				AND (expires_at IS NULL OR expires_at > now())`,
+			uuid.UUID(token), pq.Array(keyStrings))
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "select batch")
+	}
+
+	byKey := make(map[Key]BatchGetResult, len(rows))
+	for _, row := range rows {
+		result := BatchGetResult{Key: Key(row.Key), Version: row.Version, Value: row.Value}
+
+		if row.StorageBackend == storageBackendS3 {
+			if kv.blobs == nil {
+				result = BatchGetResult{Key: Key(row.Key), Error: "value is stored in s3, but no s3 backend is configured"}
+			} else if value, err := kv.blobs.Get(row.ObjectKey.String); err != nil {
+				result = BatchGetResult{Key: Key(row.Key), Error: err.Error()}
+			} else {
+				result.Value = value
+			}
+		}
+
+		byKey[Key(row.Key)] = result
+	}
+
+	results := make([]BatchGetResult, len(keys))
+	for i, key := range keys {
+		if result, ok := byKey[key]; ok {
+			results[i] = result
+		} else {
+			results[i] = BatchGetResult{Key: key, Error: ErrNoSuchKey.Error()}
+		}
+	}
+
+	return results, nil
+}
+
+func (api API) RegisterBatchRoutesTo(router *httprouter.Router) {
+	router.POST("/token/:token/batch", api.PostValueBatch())
+	router.GET("/token/:token/batch", api.GetValueBatch())
+}
+
+func (api API) PostValueBatch() httprouter.Handle {
+	type requestValues struct {
+		Token Token `path:"token" validate:"required"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts requestValues
+		httputil.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			var items []BatchPutItem
+			if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+				return nil, errors.WithMessage(err, "parse body")
+			}
+
+			results, err := api.kv.BatchPut(opts.Token, items)
+			if err == ErrVersionConflict {
+				// the batch was rolled back, but we still report which keys
+				// conflicted so the caller knows what to retry.
+				return results, nil
+			}
+
+			return results, errors.WithMessage(err, "batch put")
+		})
+	}
+}
+
+func (api API) GetValueBatch() httprouter.Handle {
+	type requestValues struct {
+		Token Token `path:"token" validate:"required"`
+		Key   []Key `query:"key"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts requestValues
+		httputil.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			results, err := api.kv.BatchGet(opts.Token, opts.Key)
+			return results, errors.WithMessage(err, "batch get")
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/handler"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+)
+
+func parseToken(s string) (Token, error) {
+	u, err := uuid.Parse(s)
+	if err != nil {
+		return Token{}, errors.WithMessage(err, "parsing token")
+	}
+
+	return Token(u), nil
+}
+
+// gqlError carries an error code as a GraphQL error extension, so that
+// clients can distinguish ErrNoSuchKey/ErrVersionConflict/ErrValueTooLarge
+// the same way REST callers do via the HTTP status code.
+type gqlError struct {
+	error
+	code string
+}
+
+func (e gqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+func wrapGraphQLError(err error) error {
+	switch err {
+	case ErrNoSuchKey:
+		return gqlError{err, "NOT_FOUND"}
+	case ErrVersionConflict:
+		return gqlError{err, "CONFLICT"}
+	case ErrValueTooLarge:
+		return gqlError{err, "PAYLOAD_TOO_LARGE"}
+	case ErrValidationFailed:
+		return gqlError{err, "VALIDATION_FAILED"}
+	default:
+		return err
+	}
+}
+
+func graphqlFieldMeter(kind, field string) metrics.Meter {
+	return metrics.GetOrRegisterMeter(fmt.Sprintf("graphql.%s[field:%s]", kind, field), nil)
+}
+
+// valueType's "value" field is base64-encoded, matching how REST encodes
+// []byte fields via encoding/json, so that arbitrary binary payloads survive
+// the round trip through GraphQL's String scalar.
+var valueType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Value",
+	Fields: graphql.Fields{
+		"version": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"value":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var historyEntryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "HistoryEntry",
+	Fields: graphql.Fields{
+		"version": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"created": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+	},
+})
+
+var tokenKeyArgs = graphql.FieldConfigArgument{
+	"token": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+	"key":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+}
+
+func parseTokenKey(p graphql.ResolveParams) (Token, Key, error) {
+	token, err := parseToken(p.Args["token"].(string))
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	return token, Key(p.Args["key"].(string)), nil
+}
+
+// buildSchema wires the GraphQL resolvers to api.kv, reusing the exact same
+// KVStore methods (and thus the exact same error values) as the REST API.
+func (api API) buildSchema() (graphql.Schema, error) {
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"value": &graphql.Field{
+				Type: valueType,
+				Args: tokenKeyArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					graphqlFieldMeter("query", "value").Mark(1)
+
+					token, key, err := parseTokenKey(p)
+					if err != nil {
+						return nil, err
+					}
+
+					value, version, err := api.kv.Get(token, key)
+					if err != nil {
+						metrics.GetOrRegisterMeter("value.get[success:false]", nil).Mark(1)
+						return nil, wrapGraphQLError(err)
+					}
+
+					metrics.GetOrRegisterMeter("value.get[success:true]", nil).Mark(1)
+					return map[string]interface{}{"version": version, "value": base64.StdEncoding.EncodeToString(value)}, nil
+				},
+			},
+			"valueAt": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Args: graphql.FieldConfigArgument{
+					"token":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"key":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"version": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					graphqlFieldMeter("query", "valueAt").Mark(1)
+
+					token, key, err := parseTokenKey(p)
+					if err != nil {
+						return nil, err
+					}
+
+					value, err := api.kv.GetVersion(token, key, p.Args["version"].(int))
+					if err != nil {
+						return nil, wrapGraphQLError(err)
+					}
+
+					return base64.StdEncoding.EncodeToString(value), nil
+				},
+			},
+			"history": &graphql.Field{
+				Type: graphql.NewList(historyEntryType),
+				Args: graphql.FieldConfigArgument{
+					"token": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"key":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					graphqlFieldMeter("query", "history").Mark(1)
+
+					token, key, err := parseTokenKey(p)
+					if err != nil {
+						return nil, err
+					}
+
+					entries, err := api.kv.History(token, key, p.Args["limit"].(int))
+					return entries, wrapGraphQLError(err)
+				},
+			},
+		},
+	})
+
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			// "value" is base64 encoded, same as valueType's "value" field.
+			"put": &graphql.Field{
+				Type: valueType,
+				Args: graphql.FieldConfigArgument{
+					"token":           &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"key":             &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"expectedVersion": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+					"value":           &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"ttlSeconds":      &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					graphqlFieldMeter("mutation", "put").Mark(1)
+					metrics.GetOrRegisterMeter("value.put", nil).Mark(1)
+
+					token, key, err := parseTokenKey(p)
+					if err != nil {
+						return nil, err
+					}
+
+					value, err := base64.StdEncoding.DecodeString(p.Args["value"].(string))
+					if err != nil {
+						return nil, errors.WithMessage(err, "value must be base64 encoded")
+					}
+
+					if int64(len(value)) > maxValueSize {
+						return nil, wrapGraphQLError(ErrValueTooLarge)
+					}
+
+					// GraphQL has no per-value Content-Type, so a rule that
+					// constrains it always rejects the value here - same as
+					// REST with no Content-Type header set.
+					if api.validation != nil {
+						if err := api.validation.Validate(token, key, "", value); err != nil {
+							return nil, wrapGraphQLError(err)
+						}
+					}
+
+					ttl := time.Duration(p.Args["ttlSeconds"].(int)) * time.Second
+
+					version, err := api.kv.Put(token, key, value, p.Args["expectedVersion"].(int), ttl)
+					if err != nil {
+						return nil, wrapGraphQLError(err)
+					}
+
+					return map[string]interface{}{"version": version, "value": base64.StdEncoding.EncodeToString(value)}, nil
+				},
+			},
+			"delete": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"token":           &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"key":             &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"expectedVersion": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					graphqlFieldMeter("mutation", "delete").Mark(1)
+
+					token, key, err := parseTokenKey(p)
+					if err != nil {
+						return nil, err
+					}
+
+					err = api.kv.Delete(token, key, p.Args["expectedVersion"].(int))
+					if err != nil {
+						return nil, wrapGraphQLError(err)
+					}
+
+					return true, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType, Mutation: mutationType})
+}
+
+// RegisterGraphQLRoutesTo mounts /graphql, and /playground when debug is
+// true, onto router.
+func (api API) RegisterGraphQLRoutesTo(router *httprouter.Router, debug bool) error {
+	schema, err := api.buildSchema()
+	if err != nil {
+		return err
+	}
+
+	h := handler.New(&handler.Config{Schema: &schema, Pretty: true})
+	router.Handler(http.MethodPost, "/graphql", h)
+	router.Handler(http.MethodGet, "/graphql", h)
+
+	if debug {
+		playground := handler.New(&handler.Config{Schema: &schema, Pretty: true, GraphiQL: true})
+		router.Handler(http.MethodGet, "/playground", playground)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// HistoryEntry is one version of a key, as returned by KVStore.History.
+type HistoryEntry struct {
+	Version int       `db:"version" json:"version"`
+	Created time.Time `db:"created" json:"created"`
+}
+
+// Delete removes a key, enforcing the same optimistic version check as Put
+// (expectedVersion of 0 means "delete unconditionally"). The deleted row is
+// snapshotted into kv_data_history by a BEFORE DELETE trigger, so it remains
+// visible through GetVersion/History afterwards, same as an overwritten row.
+func (kv *KVStore) Delete(token Token, key Key, expectedVersion int) error {
+	now := time.Now()
+
+	var deleted struct {
+		Version        int            `db:"version"`
+		StorageBackend string         `db:"storage_backend"`
+		ObjectKey      sql.NullString `db:"object_key"`
+	}
+
+	err := transaction(kv.db, func(tx *sqlx.Tx) error {
+		err := tx.Get(&deleted, `
+				DELETE FROM kv_data WHERE token=$1 AND key=$2 AND ($3=0 OR version=$3)
+				RETURNING version, storage_backend, object_key`,
+			uuid.UUID(token), string(key), expectedVersion)
+
+		if err == sql.ErrNoRows {
+			return ErrVersionConflict
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return enqueueOutbox(tx, PutEvent{
+			Token: token, Key: key, Version: deleted.Version, Event: eventDelete, Timestamp: now,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Usually a no-op, since the BEFORE DELETE trigger just snapshotted this
+	// same object_key into kv_data_history - but covers the case where that
+	// snapshot was skipped (ON CONFLICT DO NOTHING because the version was
+	// already archived).
+	markBlobReclaimCandidate(kv.db, kv.blobs, deleted.StorageBackend, deleted.ObjectKey)
+
+	return nil
+}
+
+// GetVersion fetches a specific version of a key, looking at the current
+// row in kv_data first and falling back to kv_data_history.
+func (kv *KVStore) GetVersion(token Token, key Key, version int) ([]byte, error) {
+	var result struct {
+		Value          []byte         `db:"payload"`
+		StorageBackend string         `db:"storage_backend"`
+		ObjectKey      sql.NullString `db:"object_key"`
+	}
+
+	err := transaction(kv.db, func(tx *sqlx.Tx) error {
+		err := tx.Get(&result, `
+			SELECT payload, storage_backend, object_key FROM kv_data
+			WHERE token=$1 AND key=$2 AND version=$3
+				AND (expires_at IS NULL OR expires_at > now())`,
+			uuid.UUID(token), string(key), version)
+
+		if err == sql.ErrNoRows {
+			// Versions restart at 1 every time a key is deleted and recreated,
+			// so without scoping to the key's current incarnation this could
+			// match a stale row left behind by an earlier incarnation that
+			// happened to pass through the same version number.
+			err = tx.Get(&result, `
+				SELECT payload, storage_backend, object_key FROM kv_data_history
+				WHERE token=$1 AND key=$2 AND version=$3
+					AND incarnation = COALESCE(
+						(SELECT incarnation FROM kv_data WHERE token=$1 AND key=$2),
+						(SELECT max(incarnation) FROM kv_data_history WHERE token=$1 AND key=$2))`,
+				uuid.UUID(token), string(key), version)
+		}
+
+		return err
+	})
+
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchKey
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result.StorageBackend == storageBackendS3 {
+		if kv.blobs == nil {
+			return nil, errors.New("value is stored in s3, but no s3 backend is configured")
+		}
+
+		return kv.blobs.Get(result.ObjectKey.String)
+	}
+
+	return result.Value, nil
+}
+
+// History returns up to limit versions of a key, newest first.
+func (kv *KVStore) History(token Token, key Key, limit int) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+
+	err := transaction(kv.db, func(tx *sqlx.Tx) error {
+		// Same incarnation scoping as GetVersion, so history from a deleted
+		// and recreated key's earlier life doesn't bleed into this one's.
+		return tx.Select(&entries, `
+			SELECT version, created FROM (
+				SELECT version, created FROM kv_data WHERE token=$1 AND key=$2
+				UNION ALL
+				SELECT version, created FROM kv_data_history WHERE token=$1 AND key=$2
+					AND incarnation = COALESCE(
+						(SELECT incarnation FROM kv_data WHERE token=$1 AND key=$2),
+						(SELECT max(incarnation) FROM kv_data_history WHERE token=$1 AND key=$2))
+			) AS versions
+			ORDER BY version DESC LIMIT $3`,
+			uuid.UUID(token), string(key), limit)
+	})
+
+	return entries, errors.WithMessage(err, "select history")
+}
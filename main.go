@@ -1,21 +1,43 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
 	"github.com/flachnetz/startup"
 	"github.com/flachnetz/startup/startup_http"
 	"github.com/flachnetz/startup/startup_metrics"
 	"github.com/flachnetz/startup/startup_postgres"
 	"github.com/gorilla/handlers"
+	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"net/http"
 )
 
+// maxValueSizeWithS3 replaces maxValueSize once the S3 backend is enabled,
+// since large values no longer have to round-trip through Postgres.
+const maxValueSizeWithS3 = 16 * 1024 * 1024
+
 func main() {
 	var opts struct {
 		Base     startup.BaseOptions
 		Metrics  startup_metrics.MetricsOptions
 		Postgres startup_postgres.PostgresOptions
 		HTTP     startup_http.HTTPOptions
+		S3       S3Options
+		Redis    RedisOptions
+		Admin    AdminOptions
+		Leader   LeaderOptions
+
+		GraphQLPlayground   bool          `long:"graphql-playground" env:"GRAPHQL_PLAYGROUND" description:"Serve a GraphiQL UI at /playground."`
+		MaintenanceInterval time.Duration `long:"maintenance-interval" env:"MAINTENANCE_INTERVAL" default:"1m" description:"How often to sweep expired keys and prune history."`
+		MaintenanceBatch    int           `long:"maintenance-batch" env:"MAINTENANCE_BATCH" default:"1000" description:"Max rows the maintenance sweep touches per tick."`
+		HistoryLimit        int           `long:"history-limit" env:"HISTORY_LIMIT" default:"100" description:"Number of historical versions kept per key."`
+		BlobReclaimGrace    time.Duration `long:"blob-reclaim-grace" env:"BLOB_RECLAIM_GRACE" default:"10m" description:"How long a blob must sit unreferenced before maintenance deletes it, so a concurrent upload deduping against it has time to commit its reference."`
 	}
 
 	opts.Metrics.Inputs.MetricsPrefix = "kv"
@@ -27,12 +49,54 @@ func main() {
 	db := opts.Postgres.Connection()
 	defer db.Close()
 
-	api := API{kv: KVStore{db: db}}
+	queue := NewTaskQueue(opts.Redis.Client())
+
+	// `kv consumer` runs the webhook delivery loop instead of the HTTP API.
+	if len(os.Args) > 1 && os.Args[1] == "consumer" {
+		runConsumer(db, queue)
+		return
+	}
+
+	blobs, err := opts.S3.Client()
+	if err != nil {
+		logrus.Fatal(errors.WithMessage(err, "configure s3 backend"))
+	}
+
+	if blobs != nil {
+		maxValueSize = maxValueSizeWithS3
+	}
+
+	validation := NewValidationRules(db)
+
+	api := API{kv: KVStore{db: db, blobs: blobs}, validation: validation}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	poller := NewOutboxPoller(db, queue)
+	go poller.Run(stop)
+	go validation.Run(stop)
+
+	leader := &leaderFlag{}
+	leaderCtx, cancelLeaderElection := context.WithCancel(context.Background())
+	defer cancelLeaderElection()
+	go runLeaderElection(leaderCtx, opts.Leader, leader)
+
+	maintenance := NewMaintenance(db, blobs, opts.MaintenanceInterval, opts.MaintenanceBatch, opts.HistoryLimit, opts.BlobReclaimGrace)
+	go maintenance.Run(stop, leader)
 
 	opts.HTTP.Serve(startup_http.Config{
 		Name: "kv",
 		Routing: func(router *httprouter.Router) http.Handler {
 			api.RegisterTo(router)
+			api.RegisterWebhookRoutesTo(router, opts.Admin.Token)
+			api.RegisterBatchRoutesTo(router)
+			api.RegisterValidationRoutesTo(router, opts.Admin.Token)
+
+			if err := api.RegisterGraphQLRoutesTo(router, opts.GraphQLPlayground); err != nil {
+				logrus.Fatal(errors.WithMessage(err, "build graphql schema"))
+			}
+
 			compress := handlers.CompressHandler(router)
 
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -42,3 +106,22 @@ func main() {
 		},
 	})
 }
+
+// runConsumer drives webhook delivery until interrupted. It is started via
+// `kv consumer` as a separate process from the HTTP API.
+func runConsumer(db *sqlx.DB, queue *TaskQueue) {
+	consumer := NewConsumer(db, queue)
+
+	stop := make(chan struct{})
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+
+	go func() {
+		<-sig
+		close(stop)
+	}()
+
+	logrus.Info("starting webhook consumer")
+	consumer.Run(stop)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderOptions configures the lease used to make sure the maintenance
+// sweep runs on exactly one instance at a time, matching the lock type
+// controller-runtime defaults to.
+type LeaderOptions struct {
+	Enabled       bool          `long:"leader-election-enabled" env:"LEADER_ELECTION_ENABLED" description:"Gate the maintenance sweep behind k8s leader election."`
+	Namespace     string        `long:"leader-namespace" env:"LEADER_NAMESPACE" default:"default"`
+	LeaseName     string        `long:"leader-lease-name" env:"LEADER_LEASE_NAME" default:"kv-maintenance"`
+	Identity      string        `long:"leader-identity" env:"LEADER_IDENTITY" description:"Unique identity of this instance, e.g. the pod name."`
+	LeaseDuration time.Duration `long:"leader-lease-duration" env:"LEADER_LEASE_DURATION" default:"15s"`
+	RenewDeadline time.Duration `long:"leader-renew-deadline" env:"LEADER_RENEW_DEADLINE" default:"10s"`
+	RetryPeriod   time.Duration `long:"leader-retry-period" env:"LEADER_RETRY_PERIOD" default:"2s"`
+}
+
+var metricLeaderState = metrics.GetOrRegisterGaugeFloat64("leader.state[is_leader:true]", nil)
+
+// leaderFlag is a tiny atomic bool wrapper shared between the leader
+// election callbacks and the maintenance loop.
+type leaderFlag struct {
+	value int32
+}
+
+func (f *leaderFlag) set(isLeader bool) {
+	if isLeader {
+		atomic.StoreInt32(&f.value, 1)
+		metricLeaderState.Update(1)
+	} else {
+		atomic.StoreInt32(&f.value, 0)
+		metricLeaderState.Update(0)
+	}
+}
+
+func (f *leaderFlag) isLeader() bool {
+	return atomic.LoadInt32(&f.value) == 1
+}
+
+// runLeaderElection blocks running the leader election loop until ctx is
+// cancelled, calling flag.set whenever this instance gains or loses
+// leadership. If leader election is disabled this instance is always the
+// leader.
+func runLeaderElection(ctx context.Context, opts LeaderOptions, flag *leaderFlag) {
+	if !opts.Enabled {
+		flag.set(true)
+		return
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		logrus.WithError(err).Fatal("load in-cluster kube config")
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("create kubernetes client")
+	}
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock,
+		opts.Namespace, opts.LeaseName,
+		client.CoreV1(), client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: opts.Identity})
+	if err != nil {
+		logrus.WithError(err).Fatal("create leader election lock")
+	}
+
+	// RunOrDie returns once the lease is lost, so campaign again until ctx
+	// is cancelled.
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:          lock,
+			LeaseDuration: opts.LeaseDuration,
+			RenewDeadline: opts.RenewDeadline,
+			RetryPeriod:   opts.RetryPeriod,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) { flag.set(true) },
+				OnStoppedLeading: func() { flag.set(false) },
+			},
+		})
+	}
+}
+
+var (
+	metricMaintenanceDeleted = metrics.GetOrRegisterMeter("maintenance.deleted", nil)
+	metricMaintenancePruned  = metrics.GetOrRegisterMeter("maintenance.pruned", nil)
+)
+
+// Maintenance periodically deletes expired keys, prunes kv_data_history down
+// to historyLimit versions per key, and reclaims blobs that have sat
+// unreferenced for longer than blobReclaimGrace, but only while flag reports
+// that this instance is the leader.
+type Maintenance struct {
+	db               *sqlx.DB
+	blobs            *blobStore
+	interval         time.Duration
+	batchSize        int
+	historyLimit     int
+	blobReclaimGrace time.Duration
+}
+
+func NewMaintenance(db *sqlx.DB, blobs *blobStore, interval time.Duration, batchSize, historyLimit int, blobReclaimGrace time.Duration) *Maintenance {
+	return &Maintenance{
+		db: db, blobs: blobs, interval: interval,
+		batchSize: batchSize, historyLimit: historyLimit, blobReclaimGrace: blobReclaimGrace,
+	}
+}
+
+func (m *Maintenance) Run(stop <-chan struct{}, flag *leaderFlag) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ticker.C:
+			if !flag.isLeader() {
+				continue
+			}
+
+			m.sweepExpired()
+			m.pruneHistory()
+			m.reclaimBlobs()
+		}
+	}
+}
+
+func (m *Maintenance) sweepExpired() {
+	var expired []struct {
+		StorageBackend string         `db:"storage_backend"`
+		ObjectKey      sql.NullString `db:"object_key"`
+	}
+
+	err := m.db.Select(&expired, `
+		DELETE FROM kv_data WHERE ctid IN (
+			SELECT ctid FROM kv_data
+			WHERE expires_at IS NOT NULL AND expires_at <= now()
+			LIMIT $1
+		)
+		RETURNING storage_backend, object_key`, m.batchSize)
+	if err != nil {
+		logrus.WithError(errors.WithMessage(err, "sweep expired keys")).Warn("maintenance sweep failed")
+		return
+	}
+
+	metricMaintenanceDeleted.Mark(int64(len(expired)))
+
+	// Expired rows were themselves snapshotted into kv_data_history by the
+	// BEFORE DELETE trigger, so this is usually a no-op - the blob is only
+	// actually reclaimed once that history entry is later pruned below.
+	for _, row := range expired {
+		markBlobReclaimCandidate(m.db, m.blobs, row.StorageBackend, row.ObjectKey)
+	}
+}
+
+func (m *Maintenance) pruneHistory() {
+	var pruned []struct {
+		StorageBackend string         `db:"storage_backend"`
+		ObjectKey      sql.NullString `db:"object_key"`
+	}
+
+	// Retention is counted per (token, key), newest incarnation first:
+	// versions restart at 1 when a key is deleted and recreated, so ordering
+	// by version alone would rank an earlier incarnation's high version
+	// numbers above the current incarnation's recent history.
+	err := m.db.Select(&pruned, `
+		DELETE FROM kv_data_history WHERE (token, key, incarnation, version) IN (
+			SELECT token, key, incarnation, version FROM (
+				SELECT token, key, incarnation, version,
+					row_number() OVER (PARTITION BY token, key ORDER BY incarnation DESC, version DESC) AS rn
+				FROM kv_data_history
+			) ranked WHERE rn > $1
+			LIMIT $2
+		)
+		RETURNING storage_backend, object_key`, m.historyLimit, m.batchSize)
+	if err != nil {
+		logrus.WithError(errors.WithMessage(err, "prune history")).Warn("maintenance prune failed")
+		return
+	}
+
+	metricMaintenancePruned.Mark(int64(len(pruned)))
+
+	// This is the point a blob can actually become orphaned: once its last
+	// kv_data_history row is pruned and no kv_data row picked up the same
+	// content since, nothing else will ever reference its object_key.
+	for _, row := range pruned {
+		markBlobReclaimCandidate(m.db, m.blobs, row.StorageBackend, row.ObjectKey)
+	}
+}
+
+// reclaimBlobs deletes blobs whose reclaim candidate has sat unreferenced
+// for at least blobReclaimGrace. The refcount is rechecked here, at reclaim
+// time, rather than trusted from when the candidate was recorded: a
+// concurrent Put may have deduped against the blob and attached a new
+// reference to it since, in which case the candidate is dropped without
+// deleting anything.
+func (m *Maintenance) reclaimBlobs() {
+	if m.blobs == nil {
+		return
+	}
+
+	var candidates []struct {
+		ObjectKey      string `db:"object_key"`
+		StorageBackend string `db:"storage_backend"`
+	}
+
+	err := m.db.Select(&candidates, `
+		SELECT object_key, storage_backend FROM kv_blob_reclaim_candidates
+		WHERE candidate_since <= now() - ($1 * INTERVAL '1 second')
+		LIMIT $2`, m.blobReclaimGrace.Seconds(), m.batchSize)
+	if err != nil {
+		logrus.WithError(errors.WithMessage(err, "list blob reclaim candidates")).Warn("blob reclaim sweep failed")
+		return
+	}
+
+	for _, c := range candidates {
+		var refs int
+		err := m.db.Get(&refs, `
+			SELECT
+				(SELECT count(*) FROM kv_data WHERE storage_backend='s3' AND object_key=$1) +
+				(SELECT count(*) FROM kv_data_history WHERE storage_backend='s3' AND object_key=$1)`,
+			c.ObjectKey)
+		if err != nil {
+			logrus.WithError(errors.WithMessage(err, "check blob refcount")).Warn("blob reclaim skipped")
+			continue
+		}
+
+		if refs == 0 {
+			if err := m.blobs.Delete(c.ObjectKey); err != nil {
+				logrus.WithError(errors.WithMessage(err, "delete orphaned blob")).Warn("blob reclaim failed")
+				continue
+			}
+		}
+
+		if _, err := m.db.Exec(`DELETE FROM kv_blob_reclaim_candidates WHERE object_key=$1`, c.ObjectKey); err != nil {
+			logrus.WithError(errors.WithMessage(err, "clear blob reclaim candidate")).Warn("blob reclaim candidate not cleared")
+		}
+	}
+}
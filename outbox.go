@@ -0,0 +1,116 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+)
+
+// PutEvent describes a single mutation of a key and is what gets queued for
+// webhook fan-out and cache invalidation.
+type PutEvent struct {
+	Token     Token     `json:"token"`
+	Key       Key       `json:"key"`
+	Version   int       `json:"version"`
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+const (
+	eventPut    = "put"
+	eventDelete = "delete"
+)
+
+// enqueueOutbox appends evt to kv_outbox inside tx. It must be called from
+// within the same transaction that performs the write it describes, so that
+// the event is never recorded without the write (or vice versa).
+func enqueueOutbox(tx *sqlx.Tx, evt PutEvent) error {
+	_, err := tx.Exec(`
+		INSERT INTO kv_outbox (token, key, version, event, created)
+		VALUES ($1, $2, $3, $4, $5)`,
+		uuid.UUID(evt.Token), string(evt.Key), evt.Version, evt.Event, evt.Timestamp)
+
+	return errors.WithMessage(err, "insert outbox row")
+}
+
+var (
+	metricOutboxDrained = metrics.GetOrRegisterMeter("outbox.drained", nil)
+	metricOutboxFailed  = metrics.GetOrRegisterMeter("outbox.failed", nil)
+)
+
+// OutboxPoller periodically moves rows from kv_outbox onto the Redis task
+// queue, so that the enqueue inside Put never has to talk to Redis directly.
+type OutboxPoller struct {
+	db       *sqlx.DB
+	queue    *TaskQueue
+	interval time.Duration
+	batch    int
+}
+
+func NewOutboxPoller(db *sqlx.DB, queue *TaskQueue) *OutboxPoller {
+	return &OutboxPoller{db: db, queue: queue, interval: 1 * time.Second, batch: 100}
+}
+
+// Run drains the outbox until stop is closed.
+func (p *OutboxPoller) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ticker.C:
+			if err := p.drainOnce(); err != nil {
+				metricOutboxFailed.Mark(1)
+			}
+		}
+	}
+}
+
+func (p *OutboxPoller) drainOnce() error {
+	return transaction(p.db, func(tx *sqlx.Tx) error {
+		var rows []struct {
+			ID      int64     `db:"id"`
+			Token   uuid.UUID `db:"token"`
+			Key     string    `db:"key"`
+			Version int       `db:"version"`
+			Event   string    `db:"event"`
+			Created time.Time `db:"created"`
+		}
+
+		err := tx.Select(&rows, `
+			SELECT id, token, key, version, event, created FROM kv_outbox
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, p.batch)
+		if err != nil {
+			return errors.WithMessage(err, "select outbox rows")
+		}
+
+		for _, row := range rows {
+			evt := PutEvent{
+				Token:     Token(row.Token),
+				Key:       Key(row.Key),
+				Version:   row.Version,
+				Event:     row.Event,
+				Timestamp: row.Created,
+			}
+
+			if err := p.queue.Enqueue(evt); err != nil {
+				// leave the row in place, we'll retry on the next tick.
+				return errors.WithMessage(err, "enqueue task")
+			}
+
+			if _, err := tx.Exec(`DELETE FROM kv_outbox WHERE id=$1`, row.ID); err != nil {
+				return errors.WithMessage(err, "delete outbox row")
+			}
+
+			metricOutboxDrained.Mark(1)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	storageBackendInline = "inline"
+	storageBackendS3     = "s3"
+)
+
+var (
+	metricBackendInline = metrics.GetOrRegisterMeter("value.backend[type:inline]", nil)
+	metricBackendS3     = metrics.GetOrRegisterMeter("value.backend[type:s3]", nil)
+)
+
+// S3Options configures the optional object-storage backend that large
+// values are offloaded to. When Enabled is false, Client returns a nil
+// *blobStore and every value is kept inline in kv_data.payload.
+type S3Options struct {
+	Enabled   bool   `long:"s3-enabled" env:"S3_ENABLED" description:"Store values larger than s3-threshold in an S3-compatible object store."`
+	Endpoint  string `long:"s3-endpoint" env:"S3_ENDPOINT" description:"Endpoint of the S3-compatible object store, e.g. minio:9000."`
+	AccessKey string `long:"s3-access-key" env:"S3_ACCESS_KEY"`
+	SecretKey string `long:"s3-secret-key" env:"S3_SECRET_KEY"`
+	Bucket    string `long:"s3-bucket" env:"S3_BUCKET" description:"Bucket that overflow values are stored in."`
+	UseSSL    bool   `long:"s3-use-ssl" env:"S3_USE_SSL"`
+
+	// Threshold is the payload size in bytes above which a value is
+	// offloaded to the object store instead of stored inline.
+	Threshold int64 `long:"s3-threshold" env:"S3_THRESHOLD" default:"16384" description:"Values larger than this many bytes are offloaded to S3."`
+}
+
+// Client builds the blobStore described by the options, or nil if the S3
+// backend was not enabled on the command line.
+func (opts S3Options) Client() (*blobStore, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+
+	client, err := minio.New(opts.Endpoint, opts.AccessKey, opts.SecretKey, opts.UseSSL)
+	if err != nil {
+		return nil, errors.WithMessage(err, "create s3 client")
+	}
+
+	return &blobStore{client: client, bucket: opts.Bucket, threshold: opts.Threshold}, nil
+}
+
+// blobStore stores and retrieves large payloads in an S3-compatible bucket,
+// content-addressed by the sha256 of their value so that uploading the same
+// payload for a key more than once, or across keys of the same token, only
+// stores it once. The object key is prefixed with the token, so identical
+// payloads uploaded under different tokens are still stored once per token.
+type blobStore struct {
+	client    *minio.Client
+	bucket    string
+	threshold int64
+}
+
+func (b *blobStore) objectKey(token Token, sha256Hex string) string {
+	return fmt.Sprintf("%s/%s", token, sha256Hex)
+}
+
+// Put uploads the payload if an object with the same hash does not already
+// exist, and returns the object key together with the hex encoded sha256
+// sum of the value.
+func (b *blobStore) Put(token Token, value []byte) (objectKey, sha256Hex string, err error) {
+	sum := sha256.Sum256(value)
+	sha256Hex = hex.EncodeToString(sum[:])
+	objectKey = b.objectKey(token, sha256Hex)
+
+	if _, err := b.client.StatObject(b.bucket, objectKey, minio.StatObjectOptions{}); err == nil {
+		// already uploaded under this hash, nothing to do.
+		return objectKey, sha256Hex, nil
+	}
+
+	_, err = b.client.PutObject(b.bucket, objectKey, bytes.NewReader(value), int64(len(value)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+
+	return objectKey, sha256Hex, errors.WithMessage(err, "upload object")
+}
+
+func (b *blobStore) Get(objectKey string) ([]byte, error) {
+	obj, err := b.client.GetObject(b.bucket, objectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.WithMessage(err, "open object")
+	}
+	defer obj.Close()
+
+	value, err := ioutil.ReadAll(obj)
+	return value, errors.WithMessage(err, "read object")
+}
+
+func (b *blobStore) Delete(objectKey string) error {
+	return errors.WithMessage(b.client.RemoveObject(b.bucket, objectKey), "remove object")
+}
+
+// markBlobReclaimCandidate records that a row referencing objectKey was just
+// deleted, expired, or pruned, so Maintenance can later reclaim the blob
+// once it has gone unreferenced for a grace period. It does not delete
+// anything itself: checking the refcount and deleting immediately races
+// blobStore.Put's StatObject-then-skip-upload dedup path, where a
+// concurrent Put for a different key with identical content can see the
+// blob still present and commit a new row referencing it right after the
+// refcount was observed at zero. This is best-effort: errors are logged
+// rather than returned, since the Postgres row is already gone and failing
+// the caller wouldn't undo that.
+func markBlobReclaimCandidate(db *sqlx.DB, blobs *blobStore, backend string, objectKey sql.NullString) {
+	if blobs == nil || backend != storageBackendS3 || !objectKey.Valid {
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO kv_blob_reclaim_candidates (object_key, storage_backend, candidate_since)
+		VALUES ($1, $2, now())
+		ON CONFLICT (object_key) DO NOTHING`,
+		objectKey.String, backend)
+	if err != nil {
+		logrus.WithError(errors.WithMessage(err, "record blob reclaim candidate")).Warn("blob reclaim candidate not recorded")
+	}
+}
+
+// prepareStorage decides whether value should be offloaded to the blob
+// store and returns exactly what a kv_data row needs: either the inline
+// payload, or a storage_backend/object_key/sha256 reference to the blob
+// store. Put and BatchPut both call this so a value is treated the same
+// way regardless of which endpoint wrote it.
+func (kv *KVStore) prepareStorage(token Token, value []byte) (payload []byte, backend string, objectKey, sha256Hex sql.NullString, err error) {
+	if kv.blobs == nil || int64(len(value)) <= kv.blobs.threshold {
+		return value, storageBackendInline, objectKey, sha256Hex, nil
+	}
+
+	key, sum, err := kv.blobs.Put(token, value)
+	if err != nil {
+		return nil, "", objectKey, sha256Hex, errors.WithMessage(err, "upload to object store")
+	}
+
+	return nil, storageBackendS3, sql.NullString{String: key, Valid: true}, sql.NullString{String: sum, Valid: true}, nil
+}
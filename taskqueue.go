@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	redisQueueKey      = "kv:tasks"
+	redisDelayedKey    = "kv:tasks:delayed"
+	redisDeadLetterKey = "kv:tasks:dead"
+	maxTaskAttempts    = 5
+)
+
+// RedisOptions configures the Redis instance used as the task queue between
+// the outbox poller and the webhook consumer.
+type RedisOptions struct {
+	Addr     string `long:"redis-addr" env:"REDIS_ADDR" default:"localhost:6379" description:"Address of the redis instance backing the task queue."`
+	Password string `long:"redis-password" env:"REDIS_PASSWORD"`
+	DB       int    `long:"redis-db" env:"REDIS_DB" default:"0"`
+}
+
+func (opts RedisOptions) Client() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     opts.Addr,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+}
+
+// TaskQueue is a minimal Redis-backed list queue for PutEvent tasks. It is
+// deliberately simple: the outbox table is the durability guarantee, Redis
+// only needs to hold tasks between being drained and being consumed.
+type TaskQueue struct {
+	redis *redis.Client
+}
+
+func NewTaskQueue(client *redis.Client) *TaskQueue {
+	return &TaskQueue{redis: client}
+}
+
+func (q *TaskQueue) Enqueue(evt PutEvent) error {
+	payload, err := json.Marshal(task{Event: evt})
+	if err != nil {
+		return errors.WithMessage(err, "marshal task")
+	}
+
+	if err := q.redis.LPush(redisQueueKey, payload).Err(); err != nil {
+		return errors.WithMessage(err, "push task")
+	}
+
+	metricWebhookEnqueue.Mark(1)
+	return nil
+}
+
+// task wraps a PutEvent with the bookkeeping needed for retries.
+type task struct {
+	Event   PutEvent `json:"event"`
+	Attempt int      `json:"attempt"`
+}
+
+func (q *TaskQueue) pop(timeout time.Duration) (*task, error) {
+	result, err := q.redis.BRPop(timeout, redisQueueKey).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "brpop task")
+	}
+
+	var t task
+	if err := json.Unmarshal([]byte(result[1]), &t); err != nil {
+		return nil, errors.WithMessage(err, "unmarshal task")
+	}
+
+	return &t, nil
+}
+
+// requeue schedules t for retry after delay by storing it in a Redis sorted
+// set keyed by the unix time it becomes due, rather than an in-process
+// timer, so a pending retry survives a consumer restart during the backoff
+// window instead of being silently dropped.
+func (q *TaskQueue) requeue(t task, delay time.Duration) error {
+	t.Attempt++
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return errors.WithMessage(err, "marshal task")
+	}
+
+	dueAt := time.Now().Add(delay).Unix()
+	return errors.WithMessage(
+		q.redis.ZAdd(redisDelayedKey, redis.Z{Score: float64(dueAt), Member: payload}).Err(),
+		"schedule retry")
+}
+
+// promoteDueRetries moves every delayed task whose retry time has passed
+// back onto the main queue. Consumer.Run calls this once per poll loop so
+// retries scheduled by requeue actually get redelivered.
+func (q *TaskQueue) promoteDueRetries() error {
+	max := strconv.FormatInt(time.Now().Unix(), 10)
+
+	due, err := q.redis.ZRangeByScore(redisDelayedKey, redis.ZRangeBy{Min: "-inf", Max: max}).Result()
+	if err != nil {
+		return errors.WithMessage(err, "query delayed tasks")
+	}
+
+	for _, payload := range due {
+		// ZRem first and skip on a miss, so a task promoted by a concurrent
+		// consumer isn't pushed onto the queue twice.
+		removed, err := q.redis.ZRem(redisDelayedKey, payload).Result()
+		if err != nil {
+			return errors.WithMessage(err, "remove delayed task")
+		}
+		if removed == 0 {
+			continue
+		}
+
+		if err := q.redis.LPush(redisQueueKey, payload).Err(); err != nil {
+			return errors.WithMessage(err, "promote delayed task")
+		}
+	}
+
+	return nil
+}
+
+func (q *TaskQueue) deadLetter(t task) error {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return errors.WithMessage(err, "marshal dead task")
+	}
+
+	return errors.WithMessage(q.redis.LPush(redisDeadLetterKey, payload).Err(), "push dead task")
+}
+
+var (
+	// metricWebhookEnqueue counts tasks newly pushed onto redisQueueKey by
+	// Enqueue (retries promoted back onto it are counted by
+	// metricWebhookRetry instead), i.e. queue lifecycle volume - not to be confused with
+	// metricWebhookDeliverAttempt, which counts one mark per webhook HTTP
+	// call and can be several times higher per task.
+	metricWebhookEnqueue        = metrics.GetOrRegisterMeter("webhook.enqueue", nil)
+	metricWebhookDeliverAttempt = metrics.GetOrRegisterMeter("webhook.deliver_attempt", nil)
+	metricWebhookSuccess        = metrics.GetOrRegisterMeter("webhook.success", nil)
+	metricWebhookRetry          = metrics.GetOrRegisterMeter("webhook.retry", nil)
+	metricWebhookDead           = metrics.GetOrRegisterMeter("webhook.dead", nil)
+)
+
+// Consumer pops tasks off the Redis queue and delivers them to every webhook
+// subscribed to the task's token and event.
+type Consumer struct {
+	db     *sqlx.DB
+	queue  *TaskQueue
+	client *http.Client
+}
+
+func NewConsumer(db *sqlx.DB, queue *TaskQueue) *Consumer {
+	return &Consumer{db: db, queue: queue, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Run processes tasks until stop is closed.
+func (c *Consumer) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err := c.queue.promoteDueRetries(); err != nil {
+			logrus.WithError(err).Warn("promote delayed retries")
+		}
+
+		t, err := c.queue.pop(1 * time.Second)
+		if err != nil || t == nil {
+			continue
+		}
+
+		c.process(*t)
+	}
+}
+
+func (c *Consumer) process(t task) {
+	hooks, err := c.webhooksFor(t.Event.Token, t.Event.Event)
+	if err != nil {
+		c.retryOrDeadLetter(t)
+		return
+	}
+
+	for _, hook := range hooks {
+		if err := c.deliver(hook, t.Event); err != nil {
+			c.retryOrDeadLetter(t)
+			return
+		}
+	}
+
+	metricWebhookSuccess.Mark(1)
+}
+
+func (c *Consumer) retryOrDeadLetter(t task) {
+	if t.Attempt >= maxTaskAttempts {
+		metricWebhookDead.Mark(1)
+		if err := c.queue.deadLetter(t); err != nil {
+			logrus.WithError(err).Warn("dead letter task")
+		}
+		return
+	}
+
+	metricWebhookRetry.Mark(1)
+	backoff := time.Duration(1<<uint(t.Attempt)) * time.Second
+	if err := c.queue.requeue(t, backoff); err != nil {
+		logrus.WithError(err).Warn("requeue task")
+	}
+}
+
+func (c *Consumer) webhooksFor(token Token, event string) ([]Webhook, error) {
+	var hooks []Webhook
+
+	err := c.db.Select(&hooks, `
+		SELECT id, token, url, secret, event_mask, created FROM webhooks WHERE token=$1`,
+		uuid.UUID(token))
+
+	var matching []Webhook
+	for _, h := range hooks {
+		if h.handles(event) {
+			matching = append(matching, h)
+		}
+	}
+
+	return matching, errors.WithMessage(err, "select webhooks")
+}
+
+func (c *Consumer) deliver(hook Webhook, evt PutEvent) error {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return errors.WithMessage(err, "marshal event")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithMessage(err, "build request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-KV-Signature", sign(hook.Secret, body))
+
+	metricWebhookDeliverAttempt.Mark(1)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.WithMessage(err, "deliver webhook")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("webhook %s returned status %d", hook.ID, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
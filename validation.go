@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flachnetz/startup/lib/httputil"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+var ErrValidationFailed = errors.New("validation failed")
+
+func init() {
+	httputil.ErrorMapping[ErrValidationFailed] = http.StatusUnprocessableEntity
+}
+
+// ValidationRule is a single content constraint registered for keys of a
+// token matching KeyGlob (a path.Match pattern, e.g. "profile.*").
+type ValidationRule struct {
+	ID          int64          `db:"id" json:"id"`
+	Token       Token          `db:"token" json:"token"`
+	KeyGlob     string         `db:"key_glob" json:"keyGlob"`
+	ContentType sql.NullString `db:"content_type" json:"contentType,omitempty"`
+	JSONSchema  sql.NullString `db:"json_schema" json:"jsonSchema,omitempty"`
+	MaxSize     sql.NullInt64  `db:"max_size" json:"maxSize,omitempty"`
+}
+
+func (rule ValidationRule) matches(key Key) bool {
+	ok, err := path.Match(rule.KeyGlob, string(key))
+	return err == nil && ok
+}
+
+var (
+	metricValidationRejectContentType = metrics.GetOrRegisterMeter("value.validation.reject[reason:content_type]", nil)
+	metricValidationRejectSize        = metrics.GetOrRegisterMeter("value.validation.reject[reason:size]", nil)
+	metricValidationRejectSchema      = metrics.GetOrRegisterMeter("value.validation.reject[reason:schema]", nil)
+)
+
+// ValidationRules is an in-process cache of the kv_validation table,
+// refreshed periodically so that PostValue never has to hit Postgres in
+// order to validate a payload.
+type ValidationRules struct {
+	db       *sqlx.DB
+	interval time.Duration
+
+	rules   atomic.Value // []ValidationRule
+	schemas sync.Map     // rule id -> *gojsonschema.Schema
+}
+
+func NewValidationRules(db *sqlx.DB) *ValidationRules {
+	v := &ValidationRules{db: db, interval: 30 * time.Second}
+	v.rules.Store([]ValidationRule{})
+	return v
+}
+
+// Run reloads the rule cache immediately and then every v.interval, until
+// stop is closed.
+func (v *ValidationRules) Run(stop <-chan struct{}) {
+	v.reload()
+
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			v.reload()
+		}
+	}
+}
+
+func (v *ValidationRules) reload() {
+	var rules []ValidationRule
+	if err := v.db.Select(&rules, `
+		SELECT id, token, key_glob, content_type, json_schema, max_size FROM kv_validation`); err != nil {
+		return
+	}
+
+	current := make(map[int64]bool, len(rules))
+	for _, rule := range rules {
+		current[rule.ID] = true
+
+		if rule.JSONSchema.Valid {
+			schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(rule.JSONSchema.String))
+			if err == nil {
+				v.schemas.Store(rule.ID, schema)
+			}
+		}
+	}
+
+	// Drop schemas for rules that no longer exist, so deleting a rule with a
+	// json_schema doesn't leak its compiled schema in v.schemas forever.
+	v.schemas.Range(func(key, _ interface{}) bool {
+		if !current[key.(int64)] {
+			v.schemas.Delete(key)
+		}
+
+		return true
+	})
+
+	v.rules.Store(rules)
+}
+
+func (v *ValidationRules) rulesFor(token Token, key Key) []ValidationRule {
+	var matching []ValidationRule
+	for _, rule := range v.rules.Load().([]ValidationRule) {
+		if rule.Token == token && rule.matches(key) {
+			matching = append(matching, rule)
+		}
+	}
+
+	return matching
+}
+
+// Validate checks payload against every rule registered for (token, key)
+// and returns ErrValidationFailed on the first violated constraint.
+func (v *ValidationRules) Validate(token Token, key Key, contentType string, payload []byte) error {
+	mt, _, _ := mime.ParseMediaType(contentType)
+
+	for _, rule := range v.rulesFor(token, key) {
+		if rule.ContentType.Valid && mt != rule.ContentType.String {
+			metricValidationRejectContentType.Mark(1)
+			return ErrValidationFailed
+		}
+
+		if rule.MaxSize.Valid && int64(len(payload)) > rule.MaxSize.Int64 {
+			metricValidationRejectSize.Mark(1)
+			return ErrValidationFailed
+		}
+
+		if rule.JSONSchema.Valid && mt == "application/json" {
+			schema, ok := v.schemas.Load(rule.ID)
+			if !ok {
+				continue
+			}
+
+			result, err := schema.(*gojsonschema.Schema).Validate(gojsonschema.NewBytesLoader(payload))
+			if err != nil || !result.Valid() {
+				metricValidationRejectSchema.Mark(1)
+				return ErrValidationFailed
+			}
+		}
+	}
+
+	return nil
+}
+
+// AdminOptions configures the token that guards the /admin/... endpoints.
+type AdminOptions struct {
+	Token string `long:"admin-token" env:"ADMIN_TOKEN" description:"Token required in the X-Admin-Token header to reach /admin endpoints."`
+}
+
+func requireAdmin(adminToken string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if adminToken == "" || r.Header.Get("X-Admin-Token") != adminToken {
+			httputil.WriteError(w, http.StatusForbidden, errors.New("missing or invalid admin token"))
+			return
+		}
+
+		handle(w, r, params)
+	}
+}
+
+// RegisterValidationRoutesTo adds the admin CRUD endpoints for validation
+// rules, all guarded by adminToken.
+func (api API) RegisterValidationRoutesTo(router *httprouter.Router, adminToken string) {
+	router.GET("/admin/token/:token/rules", requireAdmin(adminToken, api.ListValidationRules()))
+	router.POST("/admin/token/:token/rules", requireAdmin(adminToken, api.CreateValidationRule()))
+	router.DELETE("/admin/token/:token/rules/:id", requireAdmin(adminToken, api.DeleteValidationRule()))
+}
+
+func (api API) ListValidationRules() httprouter.Handle {
+	type requestValues struct {
+		Token Token `path:"token" validate:"required"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts requestValues
+		httputil.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			var rules []ValidationRule
+			err := api.kv.db.Select(&rules, `
+				SELECT id, token, key_glob, content_type, json_schema, max_size
+				FROM kv_validation WHERE token=$1`, uuid.UUID(opts.Token))
+
+			return rules, errors.WithMessage(err, "select validation rules")
+		})
+	}
+}
+
+func (api API) CreateValidationRule() httprouter.Handle {
+	type requestValues struct {
+		Token Token `path:"token" validate:"required"`
+	}
+
+	type requestBody struct {
+		KeyGlob     string `json:"keyGlob" validate:"required"`
+		ContentType string `json:"contentType"`
+		JSONSchema  string `json:"jsonSchema"`
+		MaxSize     int64  `json:"maxSize"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts requestValues
+		httputil.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			var body requestBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				return nil, errors.WithMessage(err, "parse body")
+			}
+
+			rule := ValidationRule{
+				Token:       opts.Token,
+				KeyGlob:     body.KeyGlob,
+				ContentType: sql.NullString{String: body.ContentType, Valid: body.ContentType != ""},
+				JSONSchema:  sql.NullString{String: body.JSONSchema, Valid: body.JSONSchema != ""},
+				MaxSize:     sql.NullInt64{Int64: body.MaxSize, Valid: body.MaxSize > 0},
+			}
+
+			err := api.kv.db.Get(&rule.ID, `
+				INSERT INTO kv_validation (token, key_glob, content_type, json_schema, max_size)
+				VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+				uuid.UUID(rule.Token), rule.KeyGlob, rule.ContentType, rule.JSONSchema, rule.MaxSize)
+
+			return rule, errors.WithMessage(err, "insert validation rule")
+		})
+	}
+}
+
+func (api API) DeleteValidationRule() httprouter.Handle {
+	type requestValues struct {
+		Token Token `path:"token" validate:"required"`
+		ID    int64 `path:"id" validate:"required"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts requestValues
+		httputil.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			_, err := api.kv.db.Exec(`DELETE FROM kv_validation WHERE id=$1 AND token=$2`, opts.ID, uuid.UUID(opts.Token))
+			return nil, errors.WithMessage(err, "delete validation rule")
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flachnetz/startup/lib/httputil"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// Webhook is a per-token subscription that is notified whenever a key of
+// its token changes by one of the event kinds listed in EventMask.
+type Webhook struct {
+	ID        uuid.UUID `db:"id" json:"id"`
+	Token     Token     `db:"token" json:"token"`
+	URL       string    `db:"url" json:"url"`
+	Secret    string    `db:"secret" json:"secret,omitempty"`
+	EventMask string    `db:"event_mask" json:"eventMask"`
+	Created   time.Time `db:"created" json:"created"`
+}
+
+func (h Webhook) handles(event string) bool {
+	for _, allowed := range strings.Split(h.EventMask, ",") {
+		if strings.TrimSpace(allowed) == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func generateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.WithMessage(err, "generate secret")
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// RegisterWebhookRoutesTo adds the CRUD endpoints for webhook subscriptions,
+// all guarded by adminToken like the validation routes: a webhook's Secret
+// is usable to forge X-KV-Signature headers, so it must not be reachable
+// with the same per-token credential used for ordinary GET/PUT.
+func (api API) RegisterWebhookRoutesTo(router *httprouter.Router, adminToken string) {
+	router.GET("/admin/token/:token/webhooks", requireAdmin(adminToken, api.ListWebhooks()))
+	router.POST("/admin/token/:token/webhooks", requireAdmin(adminToken, api.CreateWebhook()))
+	router.DELETE("/admin/token/:token/webhooks/:id", requireAdmin(adminToken, api.DeleteWebhook()))
+}
+
+func (api API) ListWebhooks() httprouter.Handle {
+	type requestValues struct {
+		Token Token `path:"token" validate:"required"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts requestValues
+		httputil.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			var hooks []Webhook
+			// Secret is intentionally left out: it is only ever returned
+			// once, from CreateWebhook, since it can be used to forge
+			// X-KV-Signature headers.
+			err := api.kv.db.Select(&hooks, `
+				SELECT id, token, url, event_mask, created FROM webhooks WHERE token=$1`,
+				uuid.UUID(opts.Token))
+
+			return hooks, errors.WithMessage(err, "select webhooks")
+		})
+	}
+}
+
+func (api API) CreateWebhook() httprouter.Handle {
+	type requestValues struct {
+		Token Token `path:"token" validate:"required"`
+	}
+
+	type requestBody struct {
+		URL       string `json:"url" validate:"required,url"`
+		EventMask string `json:"eventMask"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts requestValues
+		httputil.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			var body requestBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				return nil, errors.WithMessage(err, "parse body")
+			}
+
+			if body.EventMask == "" {
+				body.EventMask = eventPut + "," + eventDelete
+			}
+
+			secret, err := generateSecret()
+			if err != nil {
+				return nil, err
+			}
+
+			hook := Webhook{
+				ID:        uuid.New(),
+				Token:     opts.Token,
+				URL:       body.URL,
+				Secret:    secret,
+				EventMask: body.EventMask,
+				Created:   time.Now(),
+			}
+
+			err = transaction(api.kv.db, func(tx *sqlx.Tx) error {
+				_, err := tx.Exec(`
+					INSERT INTO webhooks (id, token, url, secret, event_mask, created)
+					VALUES ($1, $2, $3, $4, $5, $6)`,
+					hook.ID, uuid.UUID(hook.Token), hook.URL, hook.Secret, hook.EventMask, hook.Created)
+				return err
+			})
+
+			return hook, errors.WithMessage(err, "insert webhook")
+		})
+	}
+}
+
+func (api API) DeleteWebhook() httprouter.Handle {
+	type requestValues struct {
+		Token Token  `path:"token" validate:"required"`
+		ID    string `path:"id" validate:"required"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts requestValues
+		httputil.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			id, err := uuid.Parse(opts.ID)
+			if err != nil {
+				return nil, errors.WithMessage(err, "parsing webhook id")
+			}
+
+			err = transaction(api.kv.db, func(tx *sqlx.Tx) error {
+				_, err := tx.Exec(`DELETE FROM webhooks WHERE id=$1 AND token=$2`, id, uuid.UUID(opts.Token))
+				return err
+			})
+
+			return nil, errors.WithMessage(err, "delete webhook")
+		})
+	}
+}